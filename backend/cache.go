@@ -0,0 +1,237 @@
+// Steve Phillips / elimisteve
+// 2015.03.06
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/elimisteve/cryptag"
+	"github.com/elimisteve/cryptag/types"
+)
+
+// defaultCacheTTL bounds how long AllTagPairsContext trusts its
+// on-disk cache before revalidating with the server, even if the
+// cached ETag still matches.
+const defaultCacheTTL = 5 * time.Minute
+
+// tagPairCache persists the decrypted result of the last successful
+// AllTagPairs(Context) call to disk, encrypted with wb.key, so
+// interactive callers -- which hit AllTagPairs on essentially every
+// RowsFromPlainTags, via randomFromPlain -- don't re-fetch and
+// re-decrypt every tag pair on every call.
+type tagPairCache struct {
+	mu sync.Mutex
+
+	path string
+	ttl  time.Duration
+
+	loaded       bool
+	etag         string
+	lastModified string
+	pairs        types.TagPairs
+	cachedAt     time.Time
+}
+
+// cacheFile is tagPairCache's on-disk (and, once encrypted, on-the-
+// wire) representation.
+type cacheFile struct {
+	ETag         string         `json:"etag"`
+	LastModified string         `json:"last_modified"`
+	Pairs        types.TagPairs `json:"pairs"`
+}
+
+// defaultCachePath returns the path a WebserverBackend caches tag
+// pairs at unless overridden.
+func defaultCachePath() string {
+	return filepath.Join(cryptag.TrustedBasePath, "tagpaircache")
+}
+
+// WithCacheTTL configures how long wb trusts its on-disk tag pair
+// cache before revalidating with the server, even if the cached ETag
+// still matches. The default is defaultCacheTTL.
+func WithCacheTTL(d time.Duration) Option {
+	return func(wb *WebserverBackend) error {
+		wb.cache.ttl = d
+		return nil
+	}
+}
+
+// InvalidateCache discards wb's in-memory and on-disk tag pair cache,
+// forcing the next AllTagPairs(Context) call to fully re-fetch and
+// re-decrypt every tag pair.
+func (wb *WebserverBackend) InvalidateCache() error {
+	wb.cache.mu.Lock()
+	defer wb.cache.mu.Unlock()
+
+	wb.cache.loaded = true
+	wb.cache.etag = ""
+	wb.cache.lastModified = ""
+	wb.cache.pairs = nil
+	wb.cache.cachedAt = time.Time{}
+
+	if wb.cache.path == "" {
+		return nil
+	}
+
+	if err := os.Remove(wb.cache.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing tag pair cache %s: %v", wb.cache.path, err)
+	}
+
+	return nil
+}
+
+// load populates c from disk the first time it's needed. c.mu must be
+// held.
+func (c *tagPairCache) load(wb *WebserverBackend) {
+	c.loaded = true
+
+	if c.path == "" {
+		return
+	}
+
+	payload, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading tag pair cache %s: %v", c.path, err)
+		}
+		return
+	}
+
+	if len(payload) < 24 {
+		return
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], payload[:24])
+
+	plain, err := wb.Decrypt(payload[24:], &nonce)
+	if err != nil {
+		log.Printf("Error decrypting tag pair cache %s: %v", c.path, err)
+		return
+	}
+
+	var cf cacheFile
+	if err := json.Unmarshal(plain, &cf); err != nil {
+		log.Printf("Error unmarshaling tag pair cache %s: %v", c.path, err)
+		return
+	}
+
+	c.etag = cf.ETag
+	c.lastModified = cf.LastModified
+	c.pairs = cf.Pairs
+
+	if info, err := os.Stat(c.path); err == nil {
+		c.cachedAt = info.ModTime()
+	}
+}
+
+// persist atomically writes c's current contents to disk, encrypted
+// with wb.key. c.mu must be held.
+func (c *tagPairCache) persist(wb *WebserverBackend) error {
+	if c.path == "" {
+		return nil
+	}
+
+	plain, err := json.Marshal(cacheFile{
+		ETag:         c.etag,
+		LastModified: c.lastModified,
+		Pairs:        c.pairs,
+	})
+	if err != nil {
+		return fmt.Errorf("Error marshaling tag pair cache: %v", err)
+	}
+
+	nonce, err := cryptagNonce()
+	if err != nil {
+		return err
+	}
+
+	enc, err := wb.Encrypt(plain, nonce)
+	if err != nil {
+		return fmt.Errorf("Error encrypting tag pair cache: %v", err)
+	}
+
+	payload := append(append([]byte{}, nonce[:]...), enc...)
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("Error creating tag pair cache directory: %v", err)
+	}
+
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, payload, 0600); err != nil {
+		return fmt.Errorf("Error writing tag pair cache: %v", err)
+	}
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("Error replacing tag pair cache: %v", err)
+	}
+
+	return nil
+}
+
+// fetchTagPairsConditional GETs wb.tagsUrl with If-None-Match and
+// If-Modified-Since set from etag/lastModified, if non-empty. A 304
+// response yields notModified == true and a nil pairs; otherwise
+// pairs holds the full, decrypted set and newETag/newLastModified
+// hold the response's validators, if any.
+//
+// This always fetches the complete, unscoped tag-pair set -- never
+// wb.tagsUrl scoped by wb.cursor -- since it backs the "all tag
+// pairs" cache that randomFromPlain relies on to resolve plaintext
+// tags to random ones. A cursor-scoped fetch belongs in
+// StreamTagPairs/Sync instead.
+func (wb *WebserverBackend) fetchTagPairsConditional(ctx context.Context, etag, lastModified string) (pairs types.TagPairs, notModified bool, newETag, newLastModified string, err error) {
+	ctx, cancel := wb.readCtx(ctx)
+	defer cancel()
+
+	url := wb.tagsUrl
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, false, "", "", fmt.Errorf("Error creating request for URL %s: %v", url, err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		return nil, false, "", "", fmt.Errorf("Error GETting URL %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	// This fetch is unscoped and never hands anything to a LocalStore,
+	// so it must never advance wb.cursor -- that's reserved for the
+	// Stream*/Sync paths, which hand what they fetch on to their caller
+	// or to a LocalStore. Doing
+	// so here would let an ordinary read silently move the cursor
+	// Sync later trusts, causing it to skip data it's never synced.
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, true, etag, lastModified, nil
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, false, "", "", fmt.Errorf("Error decoding tag pairs: %v", err)
+	}
+
+	for _, pair := range pairs {
+		if err = pair.Decrypt(wb.Decrypt); err != nil {
+			return nil, false, "", "", fmt.Errorf("Error from pair.Decrypt: %v", err)
+		}
+	}
+
+	return pairs, false, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
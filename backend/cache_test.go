@@ -0,0 +1,151 @@
+// Steve Phillips / elimisteve
+// 2015.03.07
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestWebserverBackend(t *testing.T, tagsUrl string) *WebserverBackend {
+	t.Helper()
+
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcde")
+
+	return &WebserverBackend{
+		tagsUrl:    tagsUrl,
+		httpClient: http.DefaultClient,
+		key:        &key,
+		cache: &tagPairCache{
+			path: filepath.Join(t.TempDir(), "tagpaircache"),
+			ttl:  time.Minute,
+		},
+	}
+}
+
+// TestAllTagPairsContextServesFromCacheWithinTTL confirms a second
+// call within c.ttl never hits the network at all.
+func TestAllTagPairsContextServesFromCacheWithinTTL(t *testing.T) {
+	var hits int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	wb := newTestWebserverBackend(t, srv.URL)
+
+	if _, err := wb.AllTagPairsContext(context.Background()); err != nil {
+		t.Fatalf("first AllTagPairsContext: %v", err)
+	}
+	if _, err := wb.AllTagPairsContext(context.Background()); err != nil {
+		t.Fatalf("second AllTagPairsContext: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("server saw %d requests, want 1 -- second call should be served from the fresh cache", got)
+	}
+}
+
+// TestAllTagPairsContextRevalidatesWithETag confirms that once the
+// cache's TTL has elapsed, AllTagPairsContext sends the cached ETag
+// back as If-None-Match, and a 304 response reuses the cached pairs
+// rather than re-decoding an empty body.
+func TestAllTagPairsContextRevalidatesWithETag(t *testing.T) {
+	var gotINM string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotINM = r.Header.Get("If-None-Match")
+		if gotINM == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	wb := newTestWebserverBackend(t, srv.URL)
+	wb.cache.ttl = 0 // force revalidation on every call
+
+	if _, err := wb.AllTagPairsContext(context.Background()); err != nil {
+		t.Fatalf("first AllTagPairsContext: %v", err)
+	}
+	if _, err := wb.AllTagPairsContext(context.Background()); err != nil {
+		t.Fatalf("second AllTagPairsContext: %v", err)
+	}
+
+	if gotINM != `"v1"` {
+		t.Fatalf("second request's If-None-Match = %q, want %q", gotINM, `"v1"`)
+	}
+}
+
+func TestAllTagPairsContextPersistsAcrossInstances(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	wb := newTestWebserverBackend(t, srv.URL)
+	if _, err := wb.AllTagPairsContext(context.Background()); err != nil {
+		t.Fatalf("AllTagPairsContext: %v", err)
+	}
+
+	// A second WebserverBackend instance pointed at the same on-disk
+	// cache path should load it rather than start cold.
+	wb2 := newTestWebserverBackend(t, srv.URL)
+	wb2.cache.path = wb.cache.path
+
+	pairs, err := wb2.AllTagPairsContext(context.Background())
+	if err != nil {
+		t.Fatalf("second instance's AllTagPairsContext: %v", err)
+	}
+	if pairs == nil {
+		t.Fatal("second instance should have loaded a (possibly empty) cached result, got nil")
+	}
+}
+
+// BenchmarkAllTagPairsContextCacheHit measures AllTagPairsContext
+// calls served from a warm in-memory cache; the server is hit only
+// once, by the priming call before the timer starts.
+func BenchmarkAllTagPairsContextCacheHit(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcde")
+
+	wb := &WebserverBackend{
+		tagsUrl:    srv.URL,
+		httpClient: http.DefaultClient,
+		key:        &key,
+		cache: &tagPairCache{
+			path: filepath.Join(b.TempDir(), "tagpaircache"),
+			ttl:  time.Minute,
+		},
+	}
+
+	if _, err := wb.AllTagPairsContext(context.Background()); err != nil {
+		b.Fatalf("priming AllTagPairsContext: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := wb.AllTagPairsContext(context.Background()); err != nil {
+			b.Fatalf("AllTagPairsContext: %v", err)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Steve Phillips / elimisteve
+// 2015.03.03
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elimisteve/cryptag/types"
+)
+
+// retryPolicy configures exponential backoff with jitter. The zero
+// value disables retrying.
+type retryPolicy struct {
+	max  int
+	base time.Duration
+	cap  time.Duration
+}
+
+// SetReadDeadline bounds how long any single GET issued by wb is
+// allowed to take, whether it comes from a Context-less method (e.g.
+// RowsFromPlainTags) or a Context-aware one; for StreamRows and
+// StreamTagPairs the bound covers reading the whole streamed
+// response. d <= 0 means no bound.
+func (wb *WebserverBackend) SetReadDeadline(d time.Duration) {
+	wb.readTimeout = d
+}
+
+// SetWriteDeadline bounds how long any single row or tag pair POST
+// (SaveRow, SaveTagPair and their Context counterparts) is allowed to
+// take. The pack and master index uploads made by Repack are not
+// bounded by it. d <= 0 means no bound.
+func (wb *WebserverBackend) SetWriteDeadline(d time.Duration) {
+	wb.writeTimeout = d
+}
+
+// readCtx derives a Context for a GET from parent, applying
+// wb.readTimeout if one's been set.
+func (wb *WebserverBackend) readCtx(parent context.Context) (context.Context, context.CancelFunc) {
+	if wb.readTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, wb.readTimeout)
+}
+
+// writeCtx derives a Context for a POST from parent, applying
+// wb.writeTimeout if one's been set.
+func (wb *WebserverBackend) writeCtx(parent context.Context) (context.Context, context.CancelFunc) {
+	if wb.writeTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, wb.writeTimeout)
+}
+
+// do issues req, retrying per wb.retry if it's configured: GETs are
+// retried on transport error or a retryable status, POSTs only on a
+// retryable status. ctx cancellation aborts a pending backoff sleep.
+func (wb *WebserverBackend) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if wb.authHeader != "" {
+		req.Header.Set("Authorization", wb.authHeader)
+	}
+
+	if wb.retry.max == 0 {
+		return wb.httpClient.Do(req)
+	}
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		resp, err = wb.httpClient.Do(req)
+		if !shouldRetry(req, resp, err) || attempt == wb.retry.max {
+			return resp, err
+		}
+
+		wait := retryAfter(resp)
+		if wait == 0 {
+			wait = backoff(wb.retry, attempt)
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// The previous attempt's transport has already read and
+		// closed req.Body; rewind it via GetBody (populated by
+		// http.NewRequestWithContext for the bytes.Reader bodies
+		// used throughout this package) before resending.
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("Error rewinding request body for retry: %v", err)
+			}
+			req.Body = body
+		}
+	}
+}
+
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Method == http.MethodGet {
+		return err != nil || isRetryableStatus(resp.StatusCode)
+	}
+	return err == nil && isRetryableStatus(resp.StatusCode)
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After response header expressed in
+// seconds, returning 0 if absent or unparseable.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// backoff returns a jittered delay for the given retry attempt (0-
+// indexed), exponential in base, capped at p.cap.
+func backoff(p retryPolicy, attempt int) time.Duration {
+	d := p.base << uint(attempt)
+	if d <= 0 || d > p.cap {
+		d = p.cap
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+//
+// Context-aware Backend methods
+//
+
+// AllTagPairsContext is the Context-aware counterpart to AllTagPairs.
+// Results are served from wb's on-disk tag pair cache when it's fresh
+// (see WithCacheTTL), and revalidated against the server with
+// If-None-Match/If-Modified-Since otherwise.
+func (wb *WebserverBackend) AllTagPairsContext(ctx context.Context) (types.TagPairs, error) {
+	c := wb.cache
+
+	c.mu.Lock()
+	if !c.loaded {
+		c.load(wb)
+	}
+	if c.pairs != nil && c.ttl > 0 && time.Since(c.cachedAt) < c.ttl {
+		pairs := c.pairs
+		c.mu.Unlock()
+		return pairs, nil
+	}
+	etag, lastModified := c.etag, c.lastModified
+	c.mu.Unlock()
+
+	pairs, notModified, newETag, newLastModified, err := wb.fetchTagPairsConditional(ctx, etag, lastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if notModified {
+		c.cachedAt = time.Now()
+		return c.pairs, nil
+	}
+
+	c.etag = newETag
+	c.lastModified = newLastModified
+	c.pairs = pairs
+	c.cachedAt = time.Now()
+
+	if err := c.persist(wb); err != nil {
+		log.Printf("Error persisting tag pair cache: %v", err)
+	}
+
+	return pairs, nil
+}
+
+// SaveRowContext is the Context-aware counterpart to SaveRow.
+func (wb *WebserverBackend) SaveRowContext(ctx context.Context, r *types.Row) (*types.Row, error) {
+	row, err := PopulateRowBeforeSave(wb, r)
+	if err != nil {
+		return nil, fmt.Errorf("Error populating row before save: %v", err)
+	}
+
+	rowBytes, err := json.Marshal(row)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshaling row: %v", err)
+	}
+
+	if types.Debug {
+		log.Printf("POSTing row data: `%s`\n", rowBytes)
+	}
+
+	ctx, cancel := wb.writeCtx(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wb.rowsUrl, bytes.NewReader(rowBytes))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request for URL %s: %v", wb.rowsUrl, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("Error POSTing row to URL %s: %v", wb.rowsUrl, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading server response body: %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Got HTTP %d from server: `%s`", resp.StatusCode, body)
+	}
+
+	newRow, err := types.NewRowFromBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating new row from server response: %v", err)
+	}
+
+	if err = PopulateRowAfterGet(wb, newRow); err != nil {
+		return nil, err
+	}
+
+	return newRow, nil
+}
+
+// SaveTagPairContext is the Context-aware counterpart to SaveTagPair.
+func (wb *WebserverBackend) SaveTagPairContext(ctx context.Context, pair *types.TagPair) (*types.TagPair, error) {
+	pairBytes, err := json.Marshal(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	if types.Debug {
+		log.Printf("POSTing tag pair data: `%s`\n", pairBytes)
+	}
+
+	ctx, cancel := wb.writeCtx(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wb.tagsUrl, bytes.NewReader(pairBytes))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request for URL %s: %v", wb.tagsUrl, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Got HTTP %d from server for data: `%s`",
+			resp.StatusCode, body)
+	}
+
+	if types.Debug {
+		log.Printf("New *TagPair created: `%#v`\n", pair)
+	}
+
+	return pair, nil
+}
+
+// TagPairsFromRandomTagsContext is the Context-aware counterpart to
+// TagPairsFromRandomTags.
+func (wb *WebserverBackend) TagPairsFromRandomTagsContext(ctx context.Context, randtags []string) (types.TagPairs, error) {
+	if len(randtags) == 0 {
+		return nil, fmt.Errorf("Can't get 0 tags")
+	}
+
+	url := wb.tagsUrl + "?tags=" + strings.Join(randtags, ",")
+	return wb.getTagsFromUrlContext(ctx, url)
+}
+
+// RowsFromPlainTagsContext is the Context-aware counterpart to
+// RowsFromPlainTags.
+func (wb *WebserverBackend) RowsFromPlainTagsContext(ctx context.Context, plaintags []string) (types.Rows, error) {
+	randtags, err := randomFromPlain(wb, plaintags)
+	if err != nil {
+		return nil, fmt.Errorf("Error from RandomTagsFromPlain: %v", err)
+	}
+	if types.Debug {
+		log.Printf("After randomTagsFromPlain: randtags == `%#v`\n", randtags)
+	}
+
+	rows, unindexed, err := wb.rowsFromIndexContext(ctx, randtags)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving rows through pack index: %v", err)
+	}
+
+	if len(unindexed) == 0 {
+		return rows, nil
+	}
+
+	fullURL := wb.rowsUrl + "?tags=" + strings.Join(unindexed, ",")
+	if types.Debug {
+		log.Printf("fullURL == `%s`\n", fullURL)
+	}
+
+	unpackedRows, err := wb.getRowsFromUrlContext(ctx, fullURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error from getRowsFromUrlContext: %v", err)
+	}
+
+	return append(rows, unpackedRows...), nil
+}
+
+//
+// Context-aware helpers
+//
+
+// getRowsFromUrlContext fetches the encrypted rows at url, decrypts
+// them, and populates each one's plaintext fields.
+func (wb *WebserverBackend) getRowsFromUrlContext(ctx context.Context, url string) (types.Rows, error) {
+	ctx, cancel := wb.readCtx(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request for URL %s: %v", url, err)
+	}
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("Error GETting URL %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	var rows types.Rows
+	if err = json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("Error decoding rows: %v", err)
+	}
+
+	for _, row := range rows {
+		if err = PopulateRowAfterGet(wb, row); err != nil {
+			return nil, fmt.Errorf("Error from PopulateRowAfterGet: %v", err)
+		}
+	}
+
+	return rows, nil
+}
+
+// getTagsFromUrlContext fetches the encrypted tag pairs at url,
+// decrypts them, and unmarshals them into a TagPairs value.
+func (wb *WebserverBackend) getTagsFromUrlContext(ctx context.Context, url string) (types.TagPairs, error) {
+	ctx, cancel := wb.readCtx(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request for URL %s: %v", url, err)
+	}
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("Error GETting URL %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	var pairs types.TagPairs
+	if err = json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, fmt.Errorf("Error decoding tag pairs: %v", err)
+	}
+
+	for _, pair := range pairs {
+		if err = pair.Decrypt(wb.Decrypt); err != nil {
+			return nil, fmt.Errorf("Error from pair.Decrypt: %v", err)
+		}
+	}
+
+	return pairs, nil
+}
@@ -0,0 +1,128 @@
+// Steve Phillips / elimisteve
+// 2015.03.07
+
+package backend
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsRetryableStatus(t *testing.T) {
+	retryable := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	for _, code := range retryable {
+		if !isRetryableStatus(code) {
+			t.Errorf("isRetryableStatus(%d) = false, want true", code)
+		}
+	}
+
+	notRetryable := []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError}
+	for _, code := range notRetryable {
+		if isRetryableStatus(code) {
+			t.Errorf("isRetryableStatus(%d) = true, want false", code)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	get, _ := http.NewRequest("GET", "http://example.com", nil)
+	post, _ := http.NewRequest("POST", "http://example.com", bytes.NewReader(nil))
+
+	if !shouldRetry(get, nil, errFake) {
+		t.Error("a GET that errored at the transport should be retried")
+	}
+	if !shouldRetry(get, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil) {
+		t.Error("a GET with a retryable status should be retried")
+	}
+	if shouldRetry(get, &http.Response{StatusCode: http.StatusOK}, nil) {
+		t.Error("a successful GET should not be retried")
+	}
+
+	if shouldRetry(post, nil, errFake) {
+		t.Error("a POST that errored at the transport should not be retried -- delivery is uncertain")
+	}
+	if !shouldRetry(post, &http.Response{StatusCode: http.StatusBadGateway}, nil) {
+		t.Error("a POST with a retryable status should be retried")
+	}
+	if shouldRetry(post, &http.Response{StatusCode: http.StatusOK}, nil) {
+		t.Error("a successful POST should not be retried")
+	}
+}
+
+var errFake = &testError{"fake transport error"}
+
+type testError struct{ s string }
+
+func (e *testError) Error() string { return e.s }
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"5"}}}
+	if got := retryAfter(resp); got != 5*time.Second {
+		t.Errorf("retryAfter = %v, want 5s", got)
+	}
+
+	if got := retryAfter(&http.Response{Header: http.Header{}}); got != 0 {
+		t.Errorf("retryAfter with no header = %v, want 0", got)
+	}
+
+	if got := retryAfter(nil); got != 0 {
+		t.Errorf("retryAfter(nil) = %v, want 0", got)
+	}
+}
+
+func TestBackoffCapped(t *testing.T) {
+	p := retryPolicy{max: 10, base: time.Second, cap: 2 * time.Second}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		d := backoff(p, attempt)
+		if d < 0 || d > p.cap {
+			t.Errorf("backoff(attempt=%d) = %v, want in [0, %v]", attempt, d, p.cap)
+		}
+	}
+}
+
+func TestDoRewindsBodyOnRetry(t *testing.T) {
+	var bodies []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		n, _ := r.Body.Read(buf)
+		bodies = append(bodies, string(buf[:n]))
+
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	wb := &WebserverBackend{
+		httpClient: srv.Client(),
+		retry:      retryPolicy{max: 1, base: time.Millisecond, cap: time.Millisecond},
+	}
+
+	req, err := http.NewRequest("POST", srv.URL, bytes.NewReader([]byte("payload")))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+
+	resp, err := wb.do(req.Context(), req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("final status = %d, want 200", resp.StatusCode)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("server saw %d requests, want 2", len(bodies))
+	}
+	if bodies[0] != "payload" || bodies[1] != "payload" {
+		t.Fatalf("server saw bodies %q, want both `payload` -- the retried POST must resend the original body", bodies)
+	}
+}
@@ -0,0 +1,119 @@
+// Steve Phillips / elimisteve
+// 2015.03.04
+
+package backend
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// defaultTorSOCKSAddr is the address the Tor daemon exposes its
+// SOCKS5 proxy on by default.
+const defaultTorSOCKSAddr = "127.0.0.1:9050"
+
+// Option configures a WebserverBackend's HTTP transport and auth at
+// construction time. Use with NewWebserverBackendWithOptions.
+type Option func(*WebserverBackend) error
+
+// WithTLSConfig has wb present tlsConfig -- e.g. a client certificate
+// -- on every request, for servers that require mutual TLS.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(wb *WebserverBackend) error {
+		wb.tlsConfig = tlsConfig
+		return nil
+	}
+}
+
+// WithBearerToken has wb send `Authorization: Bearer <token>` on
+// every request, e.g. for a server sitting behind an authenticating
+// reverse proxy.
+func WithBearerToken(token string) Option {
+	return func(wb *WebserverBackend) error {
+		wb.authHeader = "Bearer " + token
+		return nil
+	}
+}
+
+// WithBasicAuth has wb send HTTP Basic auth credentials on every
+// request.
+func WithBasicAuth(user, pass string) Option {
+	return func(wb *WebserverBackend) error {
+		creds := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		wb.authHeader = "Basic " + creds
+		return nil
+	}
+}
+
+// WithRetry configures wb to retry GETs that fail at the transport or
+// receive a 502/503/504, and POSTs that receive a 502/503/504, up to
+// max additional times. Between attempts it waits for the response's
+// Retry-After header, if any; otherwise for a random delay between 0
+// and base doubled once per prior retry, capped at maxWait.
+func WithRetry(max int, base, maxWait time.Duration) Option {
+	return func(wb *WebserverBackend) error {
+		wb.retry = retryPolicy{max: max, base: base, cap: maxWait}
+		return nil
+	}
+}
+
+// WithSOCKS5Proxy routes all of wb's traffic through the SOCKS5 proxy
+// listening at addr, e.g. to reach a cryptag server on a private
+// network.
+func WithSOCKS5Proxy(addr string) Option {
+	return func(wb *WebserverBackend) error {
+		dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+		if err != nil {
+			return fmt.Errorf("Error creating SOCKS5 dialer for %s: %v", addr, err)
+		}
+		wb.dialer = dialer
+		return nil
+	}
+}
+
+// WithTorHiddenService routes all of wb's traffic through the local
+// Tor daemon's SOCKS5 proxy, letting wb reach a cryptag server run as
+// a Tor hidden service.
+func WithTorHiddenService() Option {
+	return WithSOCKS5Proxy(defaultTorSOCKSAddr)
+}
+
+// buildTransport constructs an *http.Transport reflecting wb's
+// configured TLS settings and dialer, if any.
+func (wb *WebserverBackend) buildTransport() *http.Transport {
+	transport := &http.Transport{
+		TLSClientConfig: wb.tlsConfig,
+	}
+
+	if wb.dialer != nil {
+		transport.Dial = wb.dialer.Dial
+	}
+
+	return transport
+}
+
+// NewWebserverBackendWithOptions is like NewWebserverBackend, but
+// applies opts -- e.g. WithTLSConfig, WithBearerToken,
+// WithSOCKS5Proxy -- to configure the *http.Client used for every
+// request.
+func NewWebserverBackendWithOptions(key []byte, serverBaseUrl string, opts ...Option) (*WebserverBackend, error) {
+	ws, err := NewWebserverBackend(key, serverBaseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		if err := opt(ws); err != nil {
+			return nil, fmt.Errorf("Error applying Option: %v", err)
+		}
+	}
+
+	ws.httpClient = &http.Client{Transport: ws.buildTransport()}
+
+	return ws, nil
+}
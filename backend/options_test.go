@@ -0,0 +1,73 @@
+// Steve Phillips / elimisteve
+// 2015.03.07
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithBearerToken(t *testing.T) {
+	wb := &WebserverBackend{}
+	if err := WithBearerToken("sekrit")(wb); err != nil {
+		t.Fatalf("WithBearerToken: %v", err)
+	}
+	if wb.authHeader != "Bearer sekrit" {
+		t.Errorf("authHeader = %q, want %q", wb.authHeader, "Bearer sekrit")
+	}
+}
+
+func TestWithBasicAuth(t *testing.T) {
+	wb := &WebserverBackend{}
+	if err := WithBasicAuth("alice", "hunter2")(wb); err != nil {
+		t.Fatalf("WithBasicAuth: %v", err)
+	}
+	if wb.authHeader == "" || wb.authHeader[:6] != "Basic " {
+		t.Errorf("authHeader = %q, want it to start with `Basic `", wb.authHeader)
+	}
+}
+
+func TestWithRetryConfiguresPolicy(t *testing.T) {
+	wb := &WebserverBackend{}
+	if err := WithRetry(3, time.Second, 30*time.Second)(wb); err != nil {
+		t.Fatalf("WithRetry: %v", err)
+	}
+
+	want := retryPolicy{max: 3, base: time.Second, cap: 30 * time.Second}
+	if wb.retry != want {
+		t.Errorf("wb.retry = %+v, want %+v", wb.retry, want)
+	}
+}
+
+func TestWithSOCKS5ProxySetsDialer(t *testing.T) {
+	wb := &WebserverBackend{}
+	if err := WithSOCKS5Proxy("127.0.0.1:9050")(wb); err != nil {
+		t.Fatalf("WithSOCKS5Proxy: %v", err)
+	}
+	if wb.dialer == nil {
+		t.Error("WithSOCKS5Proxy should set wb.dialer")
+	}
+}
+
+func TestWithTorHiddenServiceSetsDialer(t *testing.T) {
+	wb := &WebserverBackend{}
+	if err := WithTorHiddenService()(wb); err != nil {
+		t.Fatalf("WithTorHiddenService: %v", err)
+	}
+	if wb.dialer == nil {
+		t.Error("WithTorHiddenService should set wb.dialer via the local Tor SOCKS5 proxy")
+	}
+}
+
+func TestBuildTransportAppliesDialer(t *testing.T) {
+	wb := &WebserverBackend{}
+	if err := WithSOCKS5Proxy("127.0.0.1:9050")(wb); err != nil {
+		t.Fatalf("WithSOCKS5Proxy: %v", err)
+	}
+
+	transport := wb.buildTransport()
+	if transport.Dial == nil {
+		t.Error("buildTransport should wire wb.dialer's Dial into the transport")
+	}
+}
@@ -0,0 +1,559 @@
+// Steve Phillips / elimisteve
+// 2015.03.02
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/elimisteve/cryptag/types"
+)
+
+// cryptagNonce generates a fresh nonce suitable for wb.Encrypt.
+func cryptagNonce() (*[24]byte, error) {
+	nonce := new([24]byte)
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("Error generating nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+// MaxPackSize is the maximum number of ciphertext bytes a single pack
+// file may accumulate before it's finalized and a new one started. A
+// single blob larger than this is still accepted into an empty pack.
+const MaxPackSize = 4 << 20 // 4MB
+
+// IndexEntry locates a single encrypted blob -- an encrypted Row or
+// TagPair -- within a pack file.
+type IndexEntry struct {
+	PackID string `json:"pack_id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// Index maps a random tag to the pack file location of the blob saved
+// under it.
+type Index struct {
+	mu      sync.RWMutex
+	entries map[string]IndexEntry
+}
+
+// NewIndex returns an empty Index.
+func NewIndex() *Index {
+	return &Index{entries: map[string]IndexEntry{}}
+}
+
+// Get returns the IndexEntry for randtag, if any.
+func (idx *Index) Get(randtag string) (IndexEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	e, ok := idx.entries[randtag]
+	return e, ok
+}
+
+// Set records where randtag's blob lives.
+func (idx *Index) Set(randtag string, e IndexEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries[randtag] = e
+}
+
+// Each calls fn once per entry in idx.
+func (idx *Index) Each(fn func(randtag string, e IndexEntry)) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for randtag, e := range idx.entries {
+		fn(randtag, e)
+	}
+}
+
+// LoadIndex decodes an Index from its JSON representation, as produced
+// by MarshalJSON-ing idx.entries.
+func LoadIndex(indexBytes []byte) (*Index, error) {
+	var entries map[string]IndexEntry
+	if err := json.Unmarshal(indexBytes, &entries); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling index: %v", err)
+	}
+	return &Index{entries: entries}, nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (idx *Index) MarshalJSON() ([]byte, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return json.Marshal(idx.entries)
+}
+
+type packedBlob struct {
+	randtag string
+	offset  int64
+	length  int64
+}
+
+// footerEntry is one row of a pack's trailing table of contents,
+// written by FinalizePack and read back by RebuildIndexFromPack.
+type footerEntry struct {
+	RandomTag string `json:"random_tag"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+}
+
+// Packer accumulates ciphertext blobs into a single append-only pack
+// file, up to MaxPackSize, before being finalized into a content-
+// addressed Pack via FinalizePack.
+type Packer struct {
+	buf   bytes.Buffer
+	blobs []packedBlob
+}
+
+// NewPacker returns an empty Packer ready to accept blobs.
+func NewPacker() *Packer {
+	return &Packer{}
+}
+
+// Add appends ciphertext to the pack under construction. It returns
+// ok == false, adding nothing, if doing so would exceed MaxPackSize and
+// the pack is non-empty; the caller should FinalizePack and start a new
+// Packer in that case.
+func (p *Packer) Add(randtag string, ciphertext []byte) (ok bool) {
+	if p.buf.Len() > 0 && p.buf.Len()+len(ciphertext) > MaxPackSize {
+		return false
+	}
+
+	offset := int64(p.buf.Len())
+	p.buf.Write(ciphertext)
+	p.blobs = append(p.blobs, packedBlob{randtag, offset, int64(len(ciphertext))})
+
+	return true
+}
+
+// Empty reports whether any blobs have been Add-ed.
+func (p *Packer) Empty() bool {
+	return len(p.blobs) == 0
+}
+
+// FinalizePack appends a trailing table of contents -- a JSON-encoded
+// []footerEntry, followed by its length as a final 8-byte big-endian
+// integer -- to the pack's blob bytes, then computes the pack's
+// content address, the hex-encoded SHA-256 of those combined bytes.
+// It returns that ID alongside the pack's raw bytes and an Index
+// entry for every blob Add-ed to p. The footer lets
+// RebuildIndexFromPack recover a pack's Index entries from the pack
+// itself, with no dependency on the out-of-band master index.
+func FinalizePack(p *Packer) (packID string, data []byte, idx *Index, err error) {
+	entries := make([]footerEntry, len(p.blobs))
+	for i, b := range p.blobs {
+		entries[i] = footerEntry{RandomTag: b.randtag, Offset: b.offset, Length: b.length}
+	}
+
+	footer, err := json.Marshal(entries)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("Error marshaling pack footer: %v", err)
+	}
+
+	data = make([]byte, 0, p.buf.Len()+len(footer)+8)
+	data = append(data, p.buf.Bytes()...)
+	data = append(data, footer...)
+
+	var footerLen [8]byte
+	binary.BigEndian.PutUint64(footerLen[:], uint64(len(footer)))
+	data = append(data, footerLen[:]...)
+
+	sum := sha256.Sum256(data)
+	packID = hex.EncodeToString(sum[:])
+
+	idx = NewIndex()
+	for _, b := range p.blobs {
+		idx.Set(b.randtag, IndexEntry{PackID: packID, Offset: b.offset, Length: b.length})
+	}
+
+	return packID, data, idx, nil
+}
+
+// RebuildIndexFromPack parses the trailing footer written by
+// FinalizePack -- a JSON table of contents followed by its 8-byte
+// length -- out of
+// a pack's raw bytes, recovering every blob's offset and length with
+// no dependency on the out-of-band master index. It's the recovery
+// path if that index is ever lost or corrupted.
+func RebuildIndexFromPack(packID string, data []byte) (*Index, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("Pack %s too short to contain a footer", packID)
+	}
+
+	footerLen := binary.BigEndian.Uint64(data[len(data)-8:])
+	if uint64(len(data)-8) < footerLen {
+		return nil, fmt.Errorf("Pack %s footer length %d exceeds pack size", packID, footerLen)
+	}
+
+	footerStart := len(data) - 8 - int(footerLen)
+
+	var entries []footerEntry
+	if err := json.Unmarshal(data[footerStart:len(data)-8], &entries); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling pack %s footer: %v", packID, err)
+	}
+
+	idx := NewIndex()
+	for _, e := range entries {
+		idx.Set(e.RandomTag, IndexEntry{PackID: packID, Offset: e.Offset, Length: e.Length})
+	}
+
+	return idx, nil
+}
+
+//
+// WebserverBackend pack support
+//
+
+// uploadPack POSTs a finalized pack's bytes to the server under its
+// content address.
+func (wb *WebserverBackend) uploadPack(packID string, data []byte) error {
+	url := wb.packsUrl + "/" + packID
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Error creating request for pack %s: %v", packID, err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := wb.do(context.Background(), req)
+	if err != nil {
+		return fmt.Errorf("Error POSTing pack %s: %v", packID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Got HTTP %d uploading pack %s: `%s`", resp.StatusCode, packID, body)
+	}
+
+	return nil
+}
+
+// fetchBlobRange issues a Range GET for the bytes [offset, offset+length)
+// of pack packID.
+func (wb *WebserverBackend) fetchBlobRange(ctx context.Context, packID string, offset, length int64) ([]byte, error) {
+	ctx, cancel := wb.readCtx(ctx)
+	defer cancel()
+
+	url := wb.packsUrl + "/" + packID
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request for pack %s: %v", packID, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching range from pack %s: %v", packID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Got HTTP %d fetching pack %s: `%s`", resp.StatusCode, packID, body)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// locatedRandtag pairs a random tag with the pack location wb.index
+// resolved it to.
+type locatedRandtag struct {
+	randtag string
+	entry   IndexEntry
+}
+
+// rowsFromIndexContext resolves randtags through wb.index, fetching
+// just their bytes from the relevant packs rather than the whole
+// /rows collection. Entries sharing a pack are grouped, and
+// adjacent/overlapping ranges within a group are coalesced into a
+// single Range GET per contiguous run, so a query matching many
+// packed rows costs one round trip per contiguous run of matching
+// blobs within a pack instead of one per row. Random tags wb.index
+// doesn't know about are returned as unindexed, in their original
+// order, for the caller to fall back on /rows for.
+func (wb *WebserverBackend) rowsFromIndexContext(ctx context.Context, randtags []string) (rows types.Rows, unindexed []string, err error) {
+	var found []locatedRandtag
+
+	for _, randtag := range randtags {
+		entry, ok := wb.index.Get(randtag)
+		if !ok {
+			unindexed = append(unindexed, randtag)
+			continue
+		}
+		found = append(found, locatedRandtag{randtag, entry})
+	}
+
+	if len(found) == 0 {
+		return nil, unindexed, nil
+	}
+
+	byPack := map[string][]locatedRandtag{}
+	for _, f := range found {
+		byPack[f.entry.PackID] = append(byPack[f.entry.PackID], f)
+	}
+
+	rowByTag := make(map[string]*types.Row, len(found))
+
+	for packID, entries := range byPack {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].entry.Offset < entries[j].entry.Offset
+		})
+
+		for i := 0; i < len(entries); {
+			clusterStart := entries[i].entry.Offset
+			clusterEnd := clusterStart + entries[i].entry.Length
+
+			j := i + 1
+			for j < len(entries) && entries[j].entry.Offset <= clusterEnd {
+				if end := entries[j].entry.Offset + entries[j].entry.Length; end > clusterEnd {
+					clusterEnd = end
+				}
+				j++
+			}
+
+			blob, err := wb.fetchBlobRange(ctx, packID, clusterStart, clusterEnd-clusterStart)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, f := range entries[i:j] {
+				localOffset := f.entry.Offset - clusterStart
+				rowBytes := blob[localOffset : localOffset+f.entry.Length]
+
+				row, err := types.NewRowFromBytes(rowBytes)
+				if err != nil {
+					return nil, nil, fmt.Errorf("Error creating row from packed bytes: %v", err)
+				}
+				if err := PopulateRowAfterGet(wb, row); err != nil {
+					return nil, nil, err
+				}
+				rowByTag[f.randtag] = row
+			}
+
+			i = j
+		}
+	}
+
+	rows = make(types.Rows, len(found))
+	for i, f := range found {
+		rows[i] = rowByTag[f.randtag]
+	}
+
+	return rows, unindexed, nil
+}
+
+// LoadIndex reads and parses wb's locally cached Index, replacing
+// wb.index. It's exported so callers can re-load the index after it's
+// refreshed out-of-band (e.g. after Repack).
+func (wb *WebserverBackend) LoadIndex(indexBytes []byte) error {
+	idx, err := LoadIndex(indexBytes)
+	if err != nil {
+		return err
+	}
+	wb.index = idx
+	return nil
+}
+
+// fetchIndex GETs the master Index uploaded by a prior Repack and
+// decrypts it with wb.key. It returns a nil Index, not an error, if
+// the server has none yet.
+func (wb *WebserverBackend) fetchIndex(ctx context.Context) (*Index, error) {
+	ctx, cancel := wb.readCtx(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", wb.indexUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request for master index: %v", err)
+	}
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("Error GETting master index: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading master index response: %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Got HTTP %d fetching master index: `%s`", resp.StatusCode, payload)
+	}
+
+	if len(payload) < 24 {
+		return nil, fmt.Errorf("Master index response too short to contain a nonce")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], payload[:24])
+
+	indexBytes, err := wb.Decrypt(payload[24:], &nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting master index: %v", err)
+	}
+
+	return LoadIndex(indexBytes)
+}
+
+// LoadIndexFromServer fetches and decrypts wb's master Index -- as
+// uploaded by a prior Repack, possibly from a different
+// WebserverBackend instance entirely -- and adopts it, so pack-backed
+// reads work without that instance ever having called Repack itself.
+// It's a no-op, not an error, if the server has no index yet.
+//
+// This isn't called automatically by NewWebserverBackend(WithOptions):
+// it's a network call with no bound but ctx and wb.readTimeout
+// (SetReadDeadline), so callers who want it opt in explicitly after
+// construction rather than risk it stalling startup.
+func (wb *WebserverBackend) LoadIndexFromServer(ctx context.Context) error {
+	idx, err := wb.fetchIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if idx == nil {
+		return nil
+	}
+	wb.index = idx
+	return nil
+}
+
+// Repack migrates rows and tag pairs currently stored as individual
+// /rows and /tags entries into content-addressed pack files. It
+// uploads the resulting packs, then uploads a master Index -- itself
+// encrypted with wb.key -- so future reads can resolve random tags to
+// pack offsets instead of re-fetching whole collections.
+func (wb *WebserverBackend) Repack() error {
+	rows, err := wb.getRowsFromUrlContext(context.Background(), wb.rowsUrl)
+	if err != nil {
+		return fmt.Errorf("Error fetching existing rows: %v", err)
+	}
+
+	pairs, err := wb.getTagsFromUrlContext(context.Background(), wb.tagsUrl)
+	if err != nil {
+		return fmt.Errorf("Error fetching existing tag pairs: %v", err)
+	}
+
+	master := NewIndex()
+	packer := NewPacker()
+
+	flush := func() error {
+		if packer.Empty() {
+			return nil
+		}
+		packID, data, idx, err := FinalizePack(packer)
+		if err != nil {
+			return err
+		}
+		if err := wb.uploadPack(packID, data); err != nil {
+			return err
+		}
+		idx.Each(func(randtag string, e IndexEntry) { master.Set(randtag, e) })
+		packer = NewPacker()
+		return nil
+	}
+
+	for _, row := range rows {
+		if len(row.RandomTags) == 0 {
+			return fmt.Errorf("Can't repack row with no RandomTags: %#v", row)
+		}
+
+		rowBytes, err := json.Marshal(row)
+		if err != nil {
+			return fmt.Errorf("Error marshaling row for repack: %v", err)
+		}
+		if !packer.Add(row.RandomTags[0], rowBytes) {
+			if err := flush(); err != nil {
+				return err
+			}
+			packer.Add(row.RandomTags[0], rowBytes)
+		}
+	}
+
+	for _, pair := range pairs {
+		if pair.Random == "" {
+			return fmt.Errorf("Can't repack tag pair with no Random tag: %#v", pair)
+		}
+
+		pairBytes, err := json.Marshal(pair)
+		if err != nil {
+			return fmt.Errorf("Error marshaling tag pair for repack: %v", err)
+		}
+		if !packer.Add(pair.Random, pairBytes) {
+			if err := flush(); err != nil {
+				return err
+			}
+			packer.Add(pair.Random, pairBytes)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	indexBytes, err := json.Marshal(master)
+	if err != nil {
+		return fmt.Errorf("Error marshaling master index: %v", err)
+	}
+
+	nonce, err := cryptagNonce()
+	if err != nil {
+		return err
+	}
+
+	encIndex, err := wb.Encrypt(indexBytes, nonce)
+	if err != nil {
+		return fmt.Errorf("Error encrypting master index: %v", err)
+	}
+
+	if err := wb.uploadIndex(nonce, encIndex); err != nil {
+		return err
+	}
+
+	wb.index = master
+
+	return nil
+}
+
+// uploadIndex POSTs the encrypted master index, prefixed with its
+// nonce, to the server.
+func (wb *WebserverBackend) uploadIndex(nonce *[24]byte, encIndex []byte) error {
+	payload := append(append([]byte{}, nonce[:]...), encIndex...)
+
+	req, err := http.NewRequest("POST", wb.indexUrl, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Error creating request for master index: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := wb.do(context.Background(), req)
+	if err != nil {
+		return fmt.Errorf("Error POSTing master index: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Got HTTP %d uploading master index: `%s`", resp.StatusCode, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+// Steve Phillips / elimisteve
+// 2015.03.07
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPackerAddBoundary(t *testing.T) {
+	p := NewPacker()
+
+	first := make([]byte, MaxPackSize)
+	if !p.Add("randtag1", first) {
+		t.Fatal("Add should accept a blob filling an empty pack exactly to MaxPackSize")
+	}
+
+	if p.Add("randtag2", []byte("x")) {
+		t.Fatal("Add should refuse a blob that would push a non-empty pack past MaxPackSize")
+	}
+
+	if p.Empty() {
+		t.Fatal("Packer holding one blob should not report Empty")
+	}
+}
+
+func TestPackerAddEmptyPackAlwaysAccepts(t *testing.T) {
+	p := NewPacker()
+
+	oversized := make([]byte, MaxPackSize+1)
+	if !p.Add("randtag1", oversized) {
+		t.Fatal("Add should accept a single oversized blob into an empty pack, rather than wedge forever")
+	}
+}
+
+func TestIndexSetGetEach(t *testing.T) {
+	idx := NewIndex()
+
+	idx.Set("randtag1", IndexEntry{PackID: "pack1", Offset: 0, Length: 10})
+	idx.Set("randtag2", IndexEntry{PackID: "pack1", Offset: 10, Length: 5})
+
+	e, ok := idx.Get("randtag1")
+	if !ok || e.PackID != "pack1" || e.Offset != 0 || e.Length != 10 {
+		t.Fatalf("Get(randtag1) = %+v, %v; want PackID=pack1 Offset=0 Length=10, true", e, ok)
+	}
+
+	if _, ok := idx.Get("missing"); ok {
+		t.Fatal("Get of an unset random tag should report ok == false")
+	}
+
+	seen := map[string]IndexEntry{}
+	idx.Each(func(randtag string, e IndexEntry) { seen[randtag] = e })
+	if len(seen) != 2 {
+		t.Fatalf("Each visited %d entries, want 2", len(seen))
+	}
+}
+
+func TestIndexMarshalLoadRoundTrip(t *testing.T) {
+	idx := NewIndex()
+	idx.Set("randtag1", IndexEntry{PackID: "pack1", Offset: 3, Length: 7})
+
+	data, err := idx.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %v", err)
+	}
+
+	loaded, err := LoadIndex(data)
+	if err != nil {
+		t.Fatalf("LoadIndex: %v", err)
+	}
+
+	e, ok := loaded.Get("randtag1")
+	if !ok || e.PackID != "pack1" || e.Offset != 3 || e.Length != 7 {
+		t.Fatalf("round-tripped entry = %+v, %v; want PackID=pack1 Offset=3 Length=7, true", e, ok)
+	}
+}
+
+func TestFinalizePackAndRebuildIndexFromPack(t *testing.T) {
+	p := NewPacker()
+	if !p.Add("randtag1", []byte("hello")) {
+		t.Fatal("Add should succeed on an empty pack")
+	}
+	if !p.Add("randtag2", []byte("world!!")) {
+		t.Fatal("Add should succeed well within MaxPackSize")
+	}
+
+	packID, data, idx, err := FinalizePack(p)
+	if err != nil {
+		t.Fatalf("FinalizePack: %v", err)
+	}
+
+	// Blob bytes must remain at the offsets FinalizePack reported --
+	// the footer is appended strictly after them.
+	e1, _ := idx.Get("randtag1")
+	if got := string(data[e1.Offset : e1.Offset+e1.Length]); got != "hello" {
+		t.Fatalf("data at randtag1's offset/length = %q, want %q", got, "hello")
+	}
+	e2, _ := idx.Get("randtag2")
+	if got := string(data[e2.Offset : e2.Offset+e2.Length]); got != "world!!" {
+		t.Fatalf("data at randtag2's offset/length = %q, want %q", got, "world!!")
+	}
+
+	rebuilt, err := RebuildIndexFromPack(packID, data)
+	if err != nil {
+		t.Fatalf("RebuildIndexFromPack: %v", err)
+	}
+
+	re1, ok := rebuilt.Get("randtag1")
+	if !ok || re1 != e1 {
+		t.Fatalf("rebuilt entry for randtag1 = %+v, %v; want %+v, true", re1, ok, e1)
+	}
+	re2, ok := rebuilt.Get("randtag2")
+	if !ok || re2 != e2 {
+		t.Fatalf("rebuilt entry for randtag2 = %+v, %v; want %+v, true", re2, ok, e2)
+	}
+}
+
+func TestRebuildIndexFromPackTooShort(t *testing.T) {
+	if _, err := RebuildIndexFromPack("deadbeef", []byte("short")); err == nil {
+		t.Fatal("RebuildIndexFromPack should error on data too short to contain a footer")
+	}
+}
+
+func TestRebuildIndexFromPackFooterLenExceedsSize(t *testing.T) {
+	// A footer length claiming more bytes than precede it must be
+	// rejected rather than panic on a negative slice bound.
+	data := make([]byte, 16)
+	data[15] = 0xff // huge bogus footer length
+	if _, err := RebuildIndexFromPack("deadbeef", data); err == nil {
+		t.Fatal("RebuildIndexFromPack should error when the footer length exceeds the pack size")
+	}
+}
+
+func TestFetchBlobRangePartialContent(t *testing.T) {
+	const full = "0123456789"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=3-5" {
+			t.Errorf("Range header = %q, want %q", r.Header.Get("Range"), "bytes=3-5")
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(full[3:6]))
+	}))
+	defer srv.Close()
+
+	wb := &WebserverBackend{
+		packsUrl:   srv.URL + "/packs",
+		httpClient: srv.Client(),
+	}
+
+	got, err := wb.fetchBlobRange(context.Background(), "packid", 3, 3)
+	if err != nil {
+		t.Fatalf("fetchBlobRange: %v", err)
+	}
+	if string(got) != "345" {
+		t.Fatalf("fetchBlobRange returned %q, want %q", got, "345")
+	}
+}
+
+func TestFetchBlobRangeErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such pack", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	wb := &WebserverBackend{
+		packsUrl:   srv.URL + "/packs",
+		httpClient: srv.Client(),
+	}
+
+	if _, err := wb.fetchBlobRange(context.Background(), "packid", 0, 1); err == nil {
+		t.Fatal("fetchBlobRange should error on a non-2xx status")
+	}
+}
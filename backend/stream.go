@@ -0,0 +1,333 @@
+// Steve Phillips / elimisteve
+// 2015.03.05
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/elimisteve/cryptag/types"
+)
+
+// RowOrError is sent on the channel returned by StreamRows. Exactly
+// one of Row or Err is set; a non-nil Err is always the final value
+// sent before the channel closes.
+type RowOrError struct {
+	Row *types.Row
+	Err error
+}
+
+// TagPairOrError is sent on the channel returned by StreamTagPairs.
+// Exactly one of Pair or Err is set; a non-nil Err is always the
+// final value sent before the channel closes.
+type TagPairOrError struct {
+	Pair *types.TagPair
+	Err  error
+}
+
+// LocalStore is the local persistence Sync pulls rows and tag pairs
+// into, plus wherever the (client-encrypted) sync cursor is kept.
+type LocalStore interface {
+	SaveRow(*types.Row) error
+	SaveTagPair(*types.TagPair) error
+	SaveCursor(encryptedCursor []byte) error
+}
+
+// LastCursor returns the opaque cursor marking wb's most recent sync
+// position, or "" if nothing's been synced yet.
+func (wb *WebserverBackend) LastCursor() string {
+	return wb.cursor
+}
+
+// SetCursor overrides wb's current sync position, e.g. after loading
+// and decrypting a cursor previously persisted via Sync.
+func (wb *WebserverBackend) SetCursor(cursor string) {
+	wb.cursor = cursor
+}
+
+// recordCursor adopts cursor as wb's new sync position, if set.
+func (wb *WebserverBackend) recordCursor(cursor string) {
+	if cursor != "" {
+		wb.cursor = cursor
+	}
+}
+
+// withCursor appends since, if non-empty, as a `since` query param to
+// url.
+func withCursor(url, since string) string {
+	if since == "" {
+		return url
+	}
+
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+
+	return url + sep + "since=" + since
+}
+
+// StreamRows resolves plaintags to random tags, then streams the
+// matching rows from the server one at a time, bounding memory use
+// regardless of how many rows match. The returned channel is closed
+// once every row's been sent, ctx is done, or an error occurs.
+//
+// It's scoped by, and advances, wb.cursor -- same as StreamTagPairs.
+// Sync needs finer control over when the cursor advances, so it calls
+// streamRowsByRandomTagsSince directly instead.
+func (wb *WebserverBackend) StreamRows(ctx context.Context, plaintags []string) (<-chan RowOrError, error) {
+	randtags, err := randomFromPlain(wb, plaintags)
+	if err != nil {
+		return nil, fmt.Errorf("Error from RandomTagsFromPlain: %v", err)
+	}
+
+	out, newCursor, err := wb.streamRowsByRandomTagsSince(ctx, randtags, wb.cursor)
+	if err != nil {
+		return nil, err
+	}
+	wb.recordCursor(newCursor)
+
+	return out, nil
+}
+
+// streamRowsByRandomTagsSince streams the rows stored under randtags
+// that were created after the since cursor (the empty string meaning
+// "the beginning"), skipping the plaintag-to-randomtag resolution
+// StreamRows does. It returns the cursor reported by the response
+// headers without touching wb.cursor; callers decide if and when to
+// adopt it.
+func (wb *WebserverBackend) streamRowsByRandomTagsSince(ctx context.Context, randtags []string, since string) (<-chan RowOrError, string, error) {
+	url := withCursor(wb.rowsUrl+"?tags="+strings.Join(randtags, ","), since)
+
+	ctx, cancel := wb.readCtx(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, "", fmt.Errorf("Error creating request for URL %s: %v", url, err)
+	}
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, "", fmt.Errorf("Error GETting URL %s: %v", url, err)
+	}
+
+	newCursor := resp.Header.Get("X-Cryptag-Cursor")
+
+	out := make(chan RowOrError)
+
+	go func() {
+		defer cancel()
+		defer resp.Body.Close()
+		defer close(out)
+
+		dec := json.NewDecoder(resp.Body)
+
+		if _, err := dec.Token(); err != nil {
+			out <- RowOrError{Err: fmt.Errorf("Error reading rows array: %v", err)}
+			return
+		}
+
+		for dec.More() {
+			var row types.Row
+			if err := dec.Decode(&row); err != nil {
+				out <- RowOrError{Err: fmt.Errorf("Error decoding row: %v", err)}
+				return
+			}
+
+			if err := PopulateRowAfterGet(wb, &row); err != nil {
+				out <- RowOrError{Err: err}
+				return
+			}
+
+			select {
+			case out <- RowOrError{Row: &row}:
+			case <-ctx.Done():
+				out <- RowOrError{Err: ctx.Err()}
+				return
+			}
+		}
+	}()
+
+	return out, newCursor, nil
+}
+
+// StreamTagPairs streams every tag pair from the server one at a
+// time, bounding memory use regardless of vault size. The returned
+// channel is closed once every pair's been sent, ctx is done, or an
+// error occurs.
+//
+// It's scoped by, and advances, wb.cursor. Sync needs finer control
+// over when the cursor advances, so it calls streamTagPairsSince
+// directly instead.
+func (wb *WebserverBackend) StreamTagPairs(ctx context.Context) (<-chan TagPairOrError, error) {
+	out, newCursor, err := wb.streamTagPairsSince(ctx, wb.cursor)
+	if err != nil {
+		return nil, err
+	}
+	wb.recordCursor(newCursor)
+
+	return out, nil
+}
+
+// streamTagPairsSince streams every tag pair created after the since
+// cursor (the empty string meaning "the beginning"). It returns the
+// cursor reported by the response headers without touching wb.cursor;
+// callers decide if and when to adopt it.
+func (wb *WebserverBackend) streamTagPairsSince(ctx context.Context, since string) (<-chan TagPairOrError, string, error) {
+	url := withCursor(wb.tagsUrl, since)
+
+	ctx, cancel := wb.readCtx(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, "", fmt.Errorf("Error creating request for URL %s: %v", url, err)
+	}
+
+	resp, err := wb.do(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, "", fmt.Errorf("Error GETting URL %s: %v", url, err)
+	}
+
+	newCursor := resp.Header.Get("X-Cryptag-Cursor")
+
+	out := make(chan TagPairOrError)
+
+	go func() {
+		defer cancel()
+		defer resp.Body.Close()
+		defer close(out)
+
+		dec := json.NewDecoder(resp.Body)
+
+		if _, err := dec.Token(); err != nil {
+			out <- TagPairOrError{Err: fmt.Errorf("Error reading tag pairs array: %v", err)}
+			return
+		}
+
+		for dec.More() {
+			var pair types.TagPair
+			if err := dec.Decode(&pair); err != nil {
+				out <- TagPairOrError{Err: fmt.Errorf("Error decoding tag pair: %v", err)}
+				return
+			}
+
+			if err := pair.Decrypt(wb.Decrypt); err != nil {
+				out <- TagPairOrError{Err: fmt.Errorf("Error from pair.Decrypt: %v", err)}
+				return
+			}
+
+			select {
+			case out <- TagPairOrError{Pair: &pair}:
+			case <-ctx.Done():
+				out <- TagPairOrError{Err: ctx.Err()}
+				return
+			}
+		}
+	}()
+
+	return out, newCursor, nil
+}
+
+// Sync pulls every tag pair and row created since wb's last cursor
+// into localStore, then persists the new cursor there, encrypted with
+// wb.key so the server never learns it in the clear.
+//
+// The cursor used to scope both the tag-pair and row fetches is the
+// one current when Sync starts; wb.cursor itself only advances once
+// the whole round has completed successfully, so a failed Sync can be
+// retried from the same starting point.
+func (wb *WebserverBackend) Sync(ctx context.Context, localStore LocalStore) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	startCursor := wb.cursor
+
+	pairCh, newCursor, err := wb.streamTagPairsSince(ctx, startCursor)
+	if err != nil {
+		return fmt.Errorf("Error starting tag pair stream: %v", err)
+	}
+
+	var randtags []string
+	var syncErr error
+
+	for poe := range pairCh {
+		if syncErr != nil {
+			continue
+		}
+		if poe.Err != nil {
+			syncErr = fmt.Errorf("Error streaming tag pairs: %v", poe.Err)
+			cancel()
+			continue
+		}
+		if err := localStore.SaveTagPair(poe.Pair); err != nil {
+			syncErr = fmt.Errorf("Error saving tag pair locally: %v", err)
+			cancel()
+			continue
+		}
+		randtags = append(randtags, poe.Pair.Random)
+	}
+	if syncErr != nil {
+		return syncErr
+	}
+
+	if len(randtags) > 0 {
+		rowCh, _, err := wb.streamRowsByRandomTagsSince(ctx, randtags, startCursor)
+		if err != nil {
+			return fmt.Errorf("Error starting row stream: %v", err)
+		}
+
+		for roe := range rowCh {
+			if syncErr != nil {
+				continue
+			}
+			if roe.Err != nil {
+				syncErr = fmt.Errorf("Error streaming rows: %v", roe.Err)
+				cancel()
+				continue
+			}
+			if err := localStore.SaveRow(roe.Row); err != nil {
+				syncErr = fmt.Errorf("Error saving row locally: %v", err)
+				cancel()
+				continue
+			}
+		}
+		if syncErr != nil {
+			return syncErr
+		}
+	}
+
+	wb.recordCursor(newCursor)
+
+	return wb.persistCursor(localStore)
+}
+
+// persistCursor encrypts wb's current cursor and hands it to
+// localStore, nonce-prefixed the same way uploadIndex prefixes the
+// master pack index.
+func (wb *WebserverBackend) persistCursor(localStore LocalStore) error {
+	if wb.cursor == "" {
+		return nil
+	}
+
+	nonce, err := cryptagNonce()
+	if err != nil {
+		return err
+	}
+
+	encCursor, err := wb.Encrypt([]byte(wb.cursor), nonce)
+	if err != nil {
+		return fmt.Errorf("Error encrypting cursor: %v", err)
+	}
+
+	payload := append(append([]byte{}, nonce[:]...), encCursor...)
+
+	return localStore.SaveCursor(payload)
+}
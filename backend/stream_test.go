@@ -0,0 +1,36 @@
+// Steve Phillips / elimisteve
+// 2015.03.07
+
+package backend
+
+import "testing"
+
+func TestWithCursor(t *testing.T) {
+	cases := []struct {
+		url, since, want string
+	}{
+		{"http://example.com/tags", "", "http://example.com/tags"},
+		{"http://example.com/tags", "abc123", "http://example.com/tags?since=abc123"},
+		{"http://example.com/rows?tags=foo,bar", "abc123", "http://example.com/rows?tags=foo,bar&since=abc123"},
+	}
+
+	for _, c := range cases {
+		if got := withCursor(c.url, c.since); got != c.want {
+			t.Errorf("withCursor(%q, %q) = %q, want %q", c.url, c.since, got, c.want)
+		}
+	}
+}
+
+func TestRecordCursorIgnoresEmpty(t *testing.T) {
+	wb := &WebserverBackend{cursor: "existing"}
+
+	wb.recordCursor("")
+	if wb.cursor != "existing" {
+		t.Errorf("recordCursor(\"\") changed cursor to %q, want unchanged %q", wb.cursor, "existing")
+	}
+
+	wb.recordCursor("new")
+	if wb.cursor != "new" {
+		t.Errorf("recordCursor(\"new\") left cursor as %q, want %q", wb.cursor, "new")
+	}
+}
@@ -4,18 +4,17 @@
 package backend
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"golang.org/x/net/proxy"
+
 	"github.com/elimisteve/cryptag"
 	"github.com/elimisteve/cryptag/types"
-	"github.com/elimisteve/fun"
 )
 
 var (
@@ -26,13 +25,59 @@ type WebserverBackend struct {
 	serverBaseUrl string
 	rowsUrl       string
 	tagsUrl       string
+	packsUrl      string
+	indexUrl      string
 
 	// cachedTags types.TagPairs
 
+	// index maps random tags to their location within a pack file, for
+	// rows and tag pairs that have been migrated there by Repack.
+	// Random tags not present here are still served from /rows and
+	// /tags directly.
+	index *Index
+
+	// httpClient issues every request made by the *Context methods.
+	// Configurable via NewWebserverBackendWithOptions.
+	httpClient *http.Client
+
+	// tlsConfig and dialer, if set via Option, feed into httpClient's
+	// Transport. See WithTLSConfig, WithSOCKS5Proxy.
+	tlsConfig *tls.Config
+	dialer    proxy.Dialer
+
+	// authHeader, if non-empty, is sent as the Authorization header on
+	// every request. See WithBearerToken, WithBasicAuth.
+	authHeader string
+
+	// cursor marks wb's most recent sync position; StreamRows,
+	// StreamTagPairs and Sync scope their requests to data created
+	// after it, while all other requests are unscoped. See Sync,
+	// LastCursor, SetCursor.
+	cursor string
+
+	// cache holds the on-disk cached result of the last AllTagPairs
+	// call. See WithCacheTTL, InvalidateCache.
+	cache *tagPairCache
+
+	// retry configures backoff for the *Context methods; the zero
+	// value disables retrying.
+	retry retryPolicy
+
+	// readTimeout/writeTimeout, if positive, bound GETs/POSTs made by
+	// both the Context-less and the Context methods. See
+	// SetReadDeadline/SetWriteDeadline.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
 	// Used for encryption/decryption
 	key *[32]byte
 }
 
+// NewWebserverBackend constructs a WebserverBackend talking to the
+// cryptag server at serverBaseUrl. It starts with an empty pack
+// Index; callers that expect packs uploaded by a prior Repack (from
+// this process or another) call LoadIndexFromServer explicitly once
+// construction returns.
 func NewWebserverBackend(key []byte, serverBaseUrl string) (*WebserverBackend, error) {
 	if serverBaseUrl == "" {
 		return nil, fmt.Errorf("Invalid serverBaseUrl `%s`", serverBaseUrl)
@@ -49,6 +94,14 @@ func NewWebserverBackend(key []byte, serverBaseUrl string) (*WebserverBackend, e
 		serverBaseUrl: serverBaseUrl,
 		rowsUrl:       serverBaseUrl + "/rows",
 		tagsUrl:       serverBaseUrl + "/tags",
+		packsUrl:      serverBaseUrl + "/packs",
+		indexUrl:      serverBaseUrl + "/index",
+		index:         NewIndex(),
+		httpClient:    &http.Client{},
+		cache: &tagPairCache{
+			path: defaultCachePath(),
+			ttl:  defaultCacheTTL,
+		},
 	}
 
 	return ws, nil
@@ -62,160 +115,32 @@ func (wb *WebserverBackend) Decrypt(cipher []byte, nonce *[24]byte) (plain []byt
 	return cryptag.Decrypt(cipher, nonce, wb.key)
 }
 
+// AllTagPairs is a Context-less wrapper around AllTagPairsContext, kept
+// for backward compatibility.
 func (wb *WebserverBackend) AllTagPairs() (types.TagPairs, error) {
-	return getTagsFromUrl(wb, wb.tagsUrl)
+	return wb.AllTagPairsContext(context.Background())
 }
 
+// SaveRow is a Context-less wrapper around SaveRowContext, kept for
+// backward compatibility.
 func (wb *WebserverBackend) SaveRow(r *types.Row) (*types.Row, error) {
-	// Populate row.{Encrypted,RandomTags} from
-	// row.{decrypted,plainTags}
-	row, err := PopulateRowBeforeSave(wb, r)
-	if err != nil {
-		return nil, fmt.Errorf("Error populating row before save: %v", err)
-	}
-
-	rowBytes, err := json.Marshal(row)
-	if err != nil {
-		return nil, fmt.Errorf("Error marshaling row: %v", err)
-	}
-
-	if types.Debug {
-		log.Printf("POSTing row data: `%s`\n", rowBytes)
-	}
-
-	resp, err := http.Post(wb.rowsUrl, "application/json",
-		bytes.NewReader(rowBytes))
-
-	if err != nil {
-		return nil, fmt.Errorf("Error POSTing row to URL %s: %v", wb.rowsUrl, err)
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading server response body: %v", err)
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Got HTTP %d from server: `%s`", resp.StatusCode, body)
-	}
-
-	newRow, err := types.NewRowFromBytes(body)
-	if err != nil {
-		return nil, fmt.Errorf("Error creating new row from server response: %v", err)
-	}
-
-	// Populated newRow.{decrypted,plainTags} from
-	// newRow.{Encrypted,RandomTags}
-	if err = PopulateRowAfterGet(wb, newRow); err != nil {
-		return nil, err
-	}
-
-	return newRow, nil
+	return wb.SaveRowContext(context.Background(), r)
 }
 
+// SaveTagPair is a Context-less wrapper around SaveTagPairContext, kept
+// for backward compatibility.
 func (wb *WebserverBackend) SaveTagPair(pair *types.TagPair) (*types.TagPair, error) {
-	pairBytes, err := json.Marshal(pair)
-	if err != nil {
-		return nil, err
-	}
-
-	if types.Debug {
-		log.Printf("POSTing tag pair data: `%s`\n", pairBytes)
-	}
-
-	resp, err := http.Post(wb.tagsUrl, "application/json",
-		bytes.NewReader(pairBytes))
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	// Error
-	if resp.StatusCode != 200 {
-		// Read server response to debug
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, fmt.Errorf("Got HTTP %d from server for data: `%s`",
-			resp.StatusCode, body)
-	}
-
-	if types.Debug {
-		log.Printf("New *TagPair created: `%#v`\n", pair)
-	}
-
-	return pair, nil
+	return wb.SaveTagPairContext(context.Background(), pair)
 }
 
+// TagPairsFromRandomTags is a Context-less wrapper around
+// TagPairsFromRandomTagsContext, kept for backward compatibility.
 func (wb *WebserverBackend) TagPairsFromRandomTags(randtags []string) (types.TagPairs, error) {
-	if len(randtags) == 0 {
-		return nil, fmt.Errorf("Can't get 0 tags")
-	}
-
-	url := wb.tagsUrl + "?tags=" + strings.Join(randtags, ",")
-	return getTagsFromUrl(wb, url)
+	return wb.TagPairsFromRandomTagsContext(context.Background(), randtags)
 }
 
+// RowsFromPlainTags is a Context-less wrapper around
+// RowsFromPlainTagsContext, kept for backward compatibility.
 func (wb *WebserverBackend) RowsFromPlainTags(plaintags []string) (types.Rows, error) {
-	randtags, err := randomFromPlain(wb, plaintags)
-	if err != nil {
-		return nil, fmt.Errorf("Error from RandomTagsFromPlain: %v", err)
-	}
-	if types.Debug {
-		log.Printf("After randomTagsFromPlain: randtags == `%#v`\n", randtags)
-	}
-
-	fullURL := wb.rowsUrl + "?tags=" + strings.Join(randtags, ",")
-	if types.Debug {
-		log.Printf("fullURL == `%s`\n", fullURL)
-	}
-
-	rows, err := getRowsFromUrl(wb, fullURL)
-	if err != nil {
-		return nil, fmt.Errorf("Error from getRowsFromUrl: %v", err)
-	}
-	return rows, nil
+	return wb.RowsFromPlainTagsContext(context.Background(), plaintags)
 }
-
-//
-// Helpers
-//
-
-// getRowsFromUrl fetches the encrypted rows from url, decrypts them, then
-func getRowsFromUrl(backend Backend, url string) (types.Rows, error) {
-	var rows types.Rows
-	var err error
-
-	if err = fun.FetchInto(url, HttpGetTimeout, &rows); err != nil {
-		return nil, fmt.Errorf("Error from FetchInto: %v", err)
-	}
-
-	for _, row := range rows {
-		if err = PopulateRowAfterGet(backend, row); err != nil {
-			return nil, fmt.Errorf("Error from PopulateRowAfterGet: %v", err)
-		}
-	}
-
-	return rows, nil
-}
-
-// getTagsFromUrl fetches the encrypted tag pairs at url, decrypts them,
-// and unmarshals them into a TagPairs value
-func getTagsFromUrl(backend Backend, url string) (types.TagPairs, error) {
-	var pairs types.TagPairs
-	var err error
-
-	if err = fun.FetchInto(url, HttpGetTimeout, &pairs); err != nil {
-		return nil, fmt.Errorf("Error fetching pairs: %v", err)
-	}
-
-	for _, pair := range pairs {
-		if err = pair.Decrypt(backend.Decrypt); err != nil {
-			return nil, fmt.Errorf("Error from pair.Decrypt: %v", err)
-		}
-	}
-
-	return pairs, nil
-}
\ No newline at end of file